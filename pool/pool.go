@@ -0,0 +1,148 @@
+// Package pool provides a generation-tagged connection pool for a single
+// server endpoint. Connections checked out of the pool remember the
+// generation they were created in; Clear bumps the generation so that
+// connections already checked out are discarded on return instead of
+// being recycled, without having to track down and close them directly.
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/10gen/mongo-go-driver/conn"
+)
+
+// ErrPoolClosed is returned by Get once the pool has been closed.
+var ErrPoolClosed = errors.New("pool: attempted to check out a connection from closed connection pool")
+
+// Pool manages a set of conn.Connections to a single endpoint, dialing
+// new ones as needed and reusing idle ones, subject to a generation
+// number that Clear can bump to invalidate everything outstanding.
+type Pool struct {
+	endpoint conn.Endpoint
+	connOpts []conn.Option
+	dialer   conn.Dialer
+
+	mu         sync.Mutex
+	generation uint64
+	idle       []conn.Connection
+	closed     bool
+}
+
+// New creates a Pool that dials connections to endpoint using dialer and
+// connOpts.
+func New(endpoint conn.Endpoint, dialer conn.Dialer, connOpts ...conn.Option) *Pool {
+	if dialer == nil {
+		dialer = conn.Dial
+	}
+	return &Pool{
+		endpoint: endpoint,
+		connOpts: connOpts,
+		dialer:   dialer,
+	}
+}
+
+// Get returns an idle connection if one is available, or dials a new
+// one. The returned connection's Close method returns it to the pool
+// instead of closing the underlying socket, unless the pool has since
+// been cleared or closed.
+func (p *Pool) Get(ctx context.Context) (conn.Connection, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	generation := p.generation
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return &pooledConnection{Connection: c, pool: p, generation: generation}, nil
+	}
+	p.mu.Unlock()
+
+	c, err := p.dialer(p.endpoint, p.connOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pooledConnection{Connection: c, pool: p, generation: generation}, nil
+}
+
+// Generation returns the pool's current generation number. A connection
+// checked out before the most recent Clear reports an older generation
+// from its own Generation method; callers can compare the two to tell
+// whether that connection has already been evicted.
+func (p *Pool) Generation() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.generation
+}
+
+// Clear bumps the pool's generation, so that connections already checked
+// out are closed (rather than pooled) when returned, and discards any
+// currently idle connections. It does not affect connections already in
+// use beyond their eventual return.
+func (p *Pool) Clear() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.generation++
+	p.mu.Unlock()
+
+	for _, c := range idle {
+		c.Close()
+	}
+}
+
+// Close clears the pool and marks it closed, so that future Gets fail
+// with ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, c := range idle {
+		c.Close()
+	}
+	return nil
+}
+
+// put returns c to the idle pool if it was checked out in the current
+// generation and the pool is still open; otherwise c is closed.
+func (p *Pool) put(c conn.Connection, generation uint64) error {
+	p.mu.Lock()
+	if p.closed || generation != p.generation {
+		p.mu.Unlock()
+		return c.Close()
+	}
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+	return nil
+}
+
+// pooledConnection wraps a conn.Connection so that Close returns it to
+// its originating Pool rather than closing the socket, as long as the
+// pool hasn't been cleared or closed since checkout.
+type pooledConnection struct {
+	conn.Connection
+	pool       *Pool
+	generation uint64
+}
+
+// Close returns the connection to the pool. It does not necessarily
+// close the underlying socket; call Pool.Clear or Pool.Close to do that.
+func (pc *pooledConnection) Close() error {
+	return pc.pool.put(pc.Connection, pc.generation)
+}
+
+// Generation returns the pool generation this connection was checked out
+// in, so a caller holding only a conn.Connection can type-assert for it
+// and compare against Pool.Generation to tell whether the connection has
+// already been evicted by a Clear.
+func (pc *pooledConnection) Generation() uint64 {
+	return pc.generation
+}
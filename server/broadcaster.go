@@ -0,0 +1,113 @@
+package server
+
+import "sync"
+
+// descBroadcaster holds the latest Desc for a server and lets any number
+// of subscribers wait for it to change. Publishing only ever replaces a
+// pointer and signals a condition variable, so a slow subscriber can
+// never block the publisher, and there is no channel send that a
+// concurrent unsubscribe could race with a close of.
+type descBroadcaster struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	latest *Desc
+	closed bool
+}
+
+func newDescBroadcaster(initial *Desc) *descBroadcaster {
+	b := &descBroadcaster{latest: initial}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// set installs desc as the latest description and wakes every waiter.
+func (b *descBroadcaster) set(desc *Desc) {
+	b.swap(desc)
+}
+
+// swap installs desc as the latest description, wakes every waiter, and
+// returns whatever was the latest description immediately beforehand.
+// Callers that need to publish a before/after pair (e.g. for a
+// ServerDescriptionChangedEvent) must use swap rather than latestDesc
+// followed by set, since another goroutine's update could otherwise land
+// in between the two calls.
+func (b *descBroadcaster) swap(desc *Desc) *Desc {
+	b.mu.Lock()
+	prev := b.latest
+	b.latest = desc
+	b.mu.Unlock()
+	b.cond.Broadcast()
+	return prev
+}
+
+// latestDesc returns the most recently set description.
+func (b *descBroadcaster) latestDesc() *Desc {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.latest
+}
+
+// close wakes every waiter a final time and marks the broadcaster
+// closed, so outstanding subscribe goroutines stop waiting and exit.
+func (b *descBroadcaster) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// subscribe returns a channel that is sent the current description and
+// every subsequent one as it's published, along with a function that
+// ends the subscription and closes the channel. The channel is never
+// closed out from under a concurrent send: only the subscription's own
+// goroutine writes to or closes it.
+//
+// A consumer that doesn't keep up isn't queued behind: if it hasn't
+// drained the previous value by the time a new one is published, it
+// coalesces to the latest rather than piling up every intermediate
+// description.
+func (b *descBroadcaster) subscribe() (<-chan *Desc, func()) {
+	ch := make(chan *Desc, 1)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+
+	go func() {
+		defer close(ch)
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		last := b.latest
+		for {
+			select {
+			case ch <- last:
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- last
+			}
+
+			for last == b.latest && !b.closed {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				b.cond.Wait()
+			}
+			if b.closed {
+				return
+			}
+			last = b.latest
+		}
+	}()
+
+	unsubscribe := func() {
+		stopOnce.Do(func() { close(stop) })
+		b.cond.Broadcast()
+	}
+
+	return ch, unsubscribe
+}
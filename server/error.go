@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net"
+	"strings"
+)
+
+// notMasterOrRecoveringMessages are substrings of the server error
+// messages that indicate a server has stepped down or is not yet ready
+// to accept writes/reads, per the SDAM error-handling spec.
+var notMasterOrRecoveringMessages = []string{
+	"not master",
+	"node is recovering",
+	"not master or secondary",
+}
+
+// isNetworkError reports whether err looks like it came from the
+// transport rather than the server itself.
+func isNetworkError(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// isNotMasterOrRecoveringError reports whether err is a server-returned
+// "not master" or "node is recovering" error, which under the SDAM spec
+// should be treated the same as a network error: the server is marked
+// Unknown and rechecked immediately.
+func isNotMasterOrRecoveringError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, candidate := range notMasterOrRecoveringMessages {
+		if strings.Contains(msg, candidate) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"time"
+
+	"github.com/10gen/mongo-go-driver/conn"
+)
+
+// ServerHeartbeatStartedEvent is published when a heartbeat is about to
+// be sent to a server.
+type ServerHeartbeatStartedEvent struct {
+	Endpoint conn.Endpoint
+}
+
+// ServerHeartbeatSucceededEvent is published when a heartbeat completes
+// successfully.
+type ServerHeartbeatSucceededEvent struct {
+	Endpoint conn.Endpoint
+	Duration time.Duration
+}
+
+// ServerHeartbeatFailedEvent is published when a heartbeat fails.
+type ServerHeartbeatFailedEvent struct {
+	Endpoint conn.Endpoint
+	Duration time.Duration
+	Err      error
+}
+
+// ServerDescriptionChangedEvent is published whenever a Monitor installs
+// a new Desc for its server, including the very first description.
+type ServerDescriptionChangedEvent struct {
+	Endpoint conn.Endpoint
+	PrevDesc *Desc
+	NewDesc  *Desc
+}
+
+// ServerMonitor is the set of SDAM event callbacks a caller can supply,
+// via WithServerMonitor, to observe a Monitor's heartbeats and
+// description changes. Any callback left nil is simply not invoked.
+type ServerMonitor struct {
+	ServerHeartbeatStarted   func(ServerHeartbeatStartedEvent)
+	ServerHeartbeatSucceeded func(ServerHeartbeatSucceededEvent)
+	ServerHeartbeatFailed    func(ServerHeartbeatFailedEvent)
+	ServerDescriptionChanged func(ServerDescriptionChangedEvent)
+}
+
+func publishServerHeartbeatStarted(sm ServerMonitor, endpoint conn.Endpoint) {
+	if sm.ServerHeartbeatStarted == nil {
+		return
+	}
+	sm.ServerHeartbeatStarted(ServerHeartbeatStartedEvent{Endpoint: endpoint})
+}
+
+func publishServerHeartbeatSucceeded(sm ServerMonitor, endpoint conn.Endpoint, duration time.Duration) {
+	if sm.ServerHeartbeatSucceeded == nil {
+		return
+	}
+	sm.ServerHeartbeatSucceeded(ServerHeartbeatSucceededEvent{Endpoint: endpoint, Duration: duration})
+}
+
+func publishServerHeartbeatFailed(sm ServerMonitor, endpoint conn.Endpoint, duration time.Duration, err error) {
+	if sm.ServerHeartbeatFailed == nil {
+		return
+	}
+	sm.ServerHeartbeatFailed(ServerHeartbeatFailedEvent{Endpoint: endpoint, Duration: duration, Err: err})
+}
+
+func publishServerDescriptionChanged(sm ServerMonitor, endpoint conn.Endpoint, prev, next *Desc) {
+	if sm.ServerDescriptionChanged == nil {
+		return
+	}
+	sm.ServerDescriptionChanged(ServerDescriptionChangedEvent{Endpoint: endpoint, PrevDesc: prev, NewDesc: next})
+}
@@ -3,8 +3,11 @@ package server
 //go:generate go run monitor_rtt_spec_internal_test_generator.go
 
 import (
+	"context"
 	"errors"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -12,28 +15,58 @@ import (
 	"github.com/10gen/mongo-go-driver/conn"
 	"github.com/10gen/mongo-go-driver/internal"
 	"github.com/10gen/mongo-go-driver/msg"
+	"github.com/10gen/mongo-go-driver/pool"
 )
 
 const minHeartbeatFreqMS = 500 * time.Millisecond
 
-// StartMonitor returns a new Monitor.
+// maxAwaitTimeMS is the value servers that support streaming isMaster
+// (MongoDB 4.4+, reported via a topologyVersion in the isMaster reply)
+// are told to block for before returning, turning the heartbeat
+// connection into a long-poll rather than a fixed-interval probe.
+const maxAwaitTimeMS = 10000
+
+// serverState describes where a Monitor is in its lifecycle. Transitions
+// only ever move forward: connected -> disconnecting -> disconnected.
+type serverState int32
+
+const (
+	serverConnected serverState = iota
+	serverDisconnecting
+	serverDisconnected
+)
+
+// StartMonitor returns a new Monitor and starts its background
+// monitoring goroutine.
 func StartMonitor(endpoint conn.Endpoint, opts ...Option) (*Monitor, error) {
 	cfg := newConfig(opts...)
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	done := make(chan struct{}, 1)
 	checkNow := make(chan struct{}, 1)
 	m := &Monitor{
 		endpoint: endpoint,
-		desc: &Desc{
+		broadcaster: newDescBroadcaster(&Desc{
 			Endpoint: endpoint,
-		},
-		subscribers:       make(map[int64]chan *Desc),
+		}),
 		done:              done,
 		checkNow:          checkNow,
 		connOpts:          cfg.connOpts,
 		dialer:            cfg.dialer,
 		heartbeatInterval: cfg.heartbeatInterval,
+		serverMonitor:     cfg.serverMonitor,
+		cfg:               cfg,
+		ctx:               ctx,
+		cancel:            cancel,
+		disconnectDone:    make(chan struct{}),
+		pool:              pool.New(endpoint, cfg.dialer, cfg.connOpts...),
+		heartbeatRetry:    cfg.heartbeatRetry,
+		backoffMax:        cfg.backoffMax,
+		backoffJitter:     cfg.backoffJitter,
+		randFloat64:       rand.Float64,
 	}
+	m.state = int32(serverConnected)
 
 	var updateServer = func(heartbeatTimer, rateLimitTimer *time.Timer) {
 		// wait if last heartbeat was less than
@@ -41,23 +74,12 @@ func StartMonitor(endpoint conn.Endpoint, opts ...Option) (*Monitor, error) {
 		<-rateLimitTimer.C
 
 		// get an updated server description
-		desc := m.heartbeat()
-		m.descLock.Lock()
-		m.desc = desc
-		m.descLock.Unlock()
-
-		// send the update to all subscribers
-		m.subscriberLock.Lock()
-		for _, ch := range m.subscribers {
-			select {
-			case <-ch:
-				// drain the channel if not empty
-			default:
-				// do nothing if chan already empty
-			}
-			ch <- desc
+		desc := m.check(m.ctx)
+		prev := m.broadcaster.swap(desc)
+
+		if m.serverMonitor.ServerDescriptionChanged != nil {
+			publishServerDescriptionChanged(m.serverMonitor, m.endpoint, prev, desc)
 		}
-		m.subscriberLock.Unlock()
 
 		// restart the timers
 		if !rateLimitTimer.Stop() {
@@ -67,10 +89,19 @@ func StartMonitor(endpoint conn.Endpoint, opts ...Option) (*Monitor, error) {
 		if !heartbeatTimer.Stop() {
 			<-heartbeatTimer.C
 		}
-		heartbeatTimer.Reset(cfg.heartbeatInterval)
+		// a streaming monitor schedules its own next check via the
+		// server's awaitable isMaster response, not a fixed interval
+		if !m.streaming() {
+			heartbeatTimer.Reset(m.nextHeartbeatInterval())
+		} else {
+			heartbeatTimer.Reset(0)
+		}
 	}
 
+	m.wg.Add(1)
 	go func() {
+		defer m.wg.Done()
+
 		heartbeatTimer := time.NewTimer(0)
 		rateLimitTimer := time.NewTimer(0)
 		for {
@@ -84,13 +115,7 @@ func StartMonitor(endpoint conn.Endpoint, opts ...Option) (*Monitor, error) {
 			case <-done:
 				heartbeatTimer.Stop()
 				rateLimitTimer.Stop()
-				m.subscriberLock.Lock()
-				for id, ch := range m.subscribers {
-					close(ch)
-					delete(m.subscribers, id)
-				}
-				m.subscriptionsClosed = true
-				m.subscriberLock.Lock()
+				m.broadcaster.close()
 				return
 			}
 		}
@@ -99,17 +124,16 @@ func StartMonitor(endpoint conn.Endpoint, opts ...Option) (*Monitor, error) {
 	return m, nil
 }
 
-// Monitor holds a channel that delivers updates to a server.
+// Monitor holds a channel that delivers updates to a server. It runs an
+// SDAM-conformant monitoring goroutine that heartbeats the server on
+// heartbeatInterval (or continuously, once the server is known to
+// support streaming isMaster) and publishes ServerDescriptionChangedEvent
+// and heartbeat events through the configured ServerMonitor.
 type Monitor struct {
-	subscribers         map[int64]chan *Desc
-	lastSubscriberID    int64
-	subscriptionsClosed bool
-	subscriberLock      sync.Mutex
+	broadcaster *descBroadcaster
 
 	conn              conn.ConnectionCloser
 	connOpts          []conn.Option
-	desc              *Desc
-	descLock          sync.Mutex
 	checkNow          chan struct{}
 	dialer            conn.Dialer
 	done              chan struct{}
@@ -117,108 +141,382 @@ type Monitor struct {
 	heartbeatInterval time.Duration
 	averageRTT        time.Duration
 	averageRTTSet     bool
+
+	cfg           *config
+	serverMonitor ServerMonitor
+
+	state          int32
+	ctx            context.Context
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+	disconnectOnce sync.Once
+	disconnectDone chan struct{}
+
+	streamingLock sync.Mutex
+	isStreaming   bool
+	rttMonitor    *RTTMonitor
+
+	pool *pool.Pool
+
+	heartbeatRetry      bool
+	backoffMax          time.Duration
+	backoffJitter       float64
+	consecutiveFailures int
+
+	// randFloat64 returns a float in [0, 1) and backs the jitter in
+	// nextHeartbeatInterval. It's a seam for tests; production monitors
+	// always use rand.Float64.
+	randFloat64 func() float64
 }
 
-// Stop turns off the monitor.
-func (m *Monitor) Stop() {
-	close(m.done)
+// connected reports whether the monitor is still in the serverConnected
+// state, i.e. Disconnect hasn't been called (or hasn't finished).
+func (m *Monitor) connected() bool {
+	return serverState(atomic.LoadInt32(&m.state)) == serverConnected
+}
+
+// errMonitorDisconnected is returned by Monitor methods that require a
+// live server once Disconnect has been called.
+var errMonitorDisconnected = errors.New("server: monitor has been disconnected")
+
+// Connection checks out an application connection from the Monitor's
+// connection pool, dialing a new one if none is idle. Callers that get a
+// network or "not master"/"node is recovering" error back from an
+// operation run on the returned connection should report it via
+// ProcessError so the server can be marked Unknown and rechecked.
+func (m *Monitor) Connection(ctx context.Context) (conn.Connection, error) {
+	if !m.connected() {
+		return nil, errMonitorDisconnected
+	}
+	return m.pool.Get(ctx)
 }
 
-// Subscribe returns a channel on which all updated server descriptions
-// will be sent. The channel will have a buffer size of one, and
-// will be pre-populated with the current description.
-// Subscribe also returns a function that, when called, will close
-// the subscription channel and remove it from the list of subscriptions.
-func (m *Monitor) Subscribe() (<-chan *Desc, func(), error) {
-	// create channel and populate with current state
-	ch := make(chan *Desc, 1)
-	m.descLock.Lock()
-	ch <- m.desc
-	m.descLock.Unlock()
+// generationGetter is implemented by connections checked out of a
+// pool.Pool, letting ProcessError tell whether c was already evicted by
+// an earlier error before redundantly marking the server down again.
+type generationGetter interface {
+	Generation() uint64
+}
+
+// ProcessError implements the SDAM error-handling rules for application
+// (non-heartbeat) errors: it marks the server Unknown, clears the
+// connection pool so stale sockets aren't handed out again, and requests
+// an immediate check so the topology learns the server's real state as
+// soon as possible. It is a no-op once the monitor has been disconnected,
+// and a no-op if c is already from a generation the pool has since
+// cleared, since that error was already acted on.
+func (m *Monitor) ProcessError(err error, c conn.Connection) {
+	if !m.connected() {
+		return
+	}
+	if err == nil {
+		return
+	}
+	if !isNetworkError(err) && !isNotMasterOrRecoveringError(err) {
+		return
+	}
+	if gg, ok := c.(generationGetter); ok && gg.Generation() != m.pool.Generation() {
+		return
+	}
 
-	// add channel to subscribers
-	m.subscriberLock.Lock()
-	if m.subscriptionsClosed {
-		return nil, nil, errors.New("cannot subscribe to monitor after stopping it")
+	next := &Desc{
+		Endpoint:  m.endpoint,
+		LastError: err,
 	}
-	m.lastSubscriberID++
-	id := m.lastSubscriberID
-	m.subscribers[id] = ch
-	m.subscriberLock.Unlock()
+	prev := m.broadcaster.swap(next)
 
-	unsubscribe := func() {
-		m.subscriberLock.Lock()
-		close(ch)
-		delete(m.subscribers, id)
-		m.subscriberLock.Unlock()
+	if m.serverMonitor.ServerDescriptionChanged != nil {
+		publishServerDescriptionChanged(m.serverMonitor, m.endpoint, prev, next)
 	}
 
-	return ch, unsubscribe, nil
+	m.pool.Clear()
+	m.RequestImmediateCheck()
+}
+
+// Disconnect cancels the monitor's context, so that an in-flight check
+// returns promptly instead of blocking on a slow or streaming isMaster
+// reply, then waits for the monitoring goroutine to exit, stops the RTT
+// monitor, and closes the connection pool. Teardown itself runs at most
+// once, in its own goroutine, regardless of how many callers or which
+// ctx triggered it; each caller of Disconnect only ever waits on its own
+// ctx, so one caller's short deadline expiring can't make a different
+// caller with a longer (or no) deadline return early, and a caller with a
+// long deadline can't make a short-deadline caller wait past its own. It
+// is safe to call Disconnect from multiple goroutines and more than once.
+func (m *Monitor) Disconnect(ctx context.Context) error {
+	m.disconnectOnce.Do(func() {
+		go func() {
+			atomic.StoreInt32(&m.state, int32(serverDisconnecting))
+			m.cancel()
+			close(m.done)
+			m.wg.Wait()
+
+			if rm := m.getRTTMonitor(); rm != nil {
+				rm.Stop()
+			}
+			m.pool.Close()
+
+			atomic.StoreInt32(&m.state, int32(serverDisconnected))
+			close(m.disconnectDone)
+		}()
+	})
+
+	select {
+	case <-m.disconnectDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop turns off the monitor. It is equivalent to calling Disconnect
+// with a context that never times out, and is kept for callers that
+// predate Disconnect.
+func (m *Monitor) Stop() {
+	_ = m.Disconnect(context.Background())
+}
+
+// LatestDesc returns the most recently observed server description, for
+// callers that want to pull the current state rather than subscribe to
+// changes.
+func (m *Monitor) LatestDesc() *Desc {
+	return m.broadcaster.latestDesc()
+}
+
+// Subscribe returns a channel that is sent the current server
+// description and every subsequent one as it changes, and a function
+// that, when called, ends the subscription and closes the channel.
+//
+// The channel is unbuffered past one pending value: a subscriber that
+// doesn't keep up coalesces to the latest description rather than
+// losing updates to an overwritten buffer or blocking the publisher, and
+// unsubscribing can never race a publish into a send on a closed
+// channel, since only the subscription's own goroutine ever sends to or
+// closes it.
+func (m *Monitor) Subscribe() (<-chan *Desc, func()) {
+	return m.broadcaster.subscribe()
 }
 
 // RequestImmediateCheck will cause the Monitor to send
 // a heartbeat to the server right away, instead of waiting for
 // the heartbeat timeout.
 func (m *Monitor) RequestImmediateCheck() {
+	if !m.connected() {
+		return
+	}
 	select {
 	case m.checkNow <- struct{}{}:
 	default:
 	}
 }
 
-func (m *Monitor) heartbeat() *Desc {
-	const maxRetryCount = 2
-	var savedErr error
-	var d *Desc
-	for i := 1; i <= maxRetryCount; i++ {
-		if m.conn == nil {
-			// TODO: should this use the connection dialer from
-			// the options? If so, it means authentication happens
-			// for heartbeat connections as well, which makes
-			// sharing a monitor in a multi-tenant arrangement
-			// impossible.
-			conn, err := conn.Dial(m.endpoint, m.connOpts...)
-			if err != nil {
-				savedErr = err
-				if conn != nil {
-					conn.Close()
-				}
-				m.conn = nil
-				continue
-			}
-			m.conn = conn
+func (m *Monitor) streaming() bool {
+	m.streamingLock.Lock()
+	defer m.streamingLock.Unlock()
+	return m.isStreaming
+}
+
+func (m *Monitor) getRTTMonitor() *RTTMonitor {
+	m.streamingLock.Lock()
+	defer m.streamingLock.Unlock()
+	return m.rttMonitor
+}
+
+// check performs a single heartbeat, honoring ctx so that a monitor
+// transitioning to disconnected (or a topology-driven cancellation)
+// interrupts an in-flight describeServer call instead of blocking
+// shutdown on it. When heartbeatRetry is set (the default), a failed
+// check is retried exactly once, immediately, on a fresh connection; a
+// second failure (or the first, with heartbeatRetry off) marks the
+// server Unknown and backs off the next check instead of retrying again.
+func (m *Monitor) check(ctx context.Context) *Desc {
+	d, err := m.attemptCheck(ctx)
+	if err != nil && m.heartbeatRetry && ctx.Err() == nil {
+		d, err = m.attemptCheck(ctx)
+	}
+
+	if err != nil {
+		m.consecutiveFailures++
+		return &Desc{
+			Endpoint:  m.endpoint,
+			LastError: err,
 		}
+	}
 
-		now := time.Now()
-		isMasterResult, buildInfoResult, err := describeServer(m.conn)
+	m.consecutiveFailures = 0
+	return d
+}
+
+// attemptCheck makes a single isMaster/buildInfo round trip, dialing a
+// new connection first if the monitor doesn't already have one.
+func (m *Monitor) attemptCheck(ctx context.Context) (*Desc, error) {
+	if m.conn == nil {
+		c, err := m.dialCtx(ctx)
 		if err != nil {
-			savedErr = err
-			m.conn.Close()
+			if c != nil {
+				c.Close()
+			}
 			m.conn = nil
-			continue
+			return nil, err
 		}
-		delay := time.Since(now)
+		m.conn = c
+	}
 
-		d = BuildDesc(m.endpoint, isMasterResult, buildInfoResult)
-		d.SetAverageRTT(m.updateAverageRTT(delay))
-		d.HeartbeatInterval = m.heartbeatInterval
+	if m.serverMonitor.ServerHeartbeatStarted != nil {
+		publishServerHeartbeatStarted(m.serverMonitor, m.endpoint)
 	}
 
-	if d == nil {
-		d = &Desc{
-			Endpoint:  m.endpoint,
-			LastError: savedErr,
+	now := time.Now()
+	isMasterResult, buildInfoResult, err := m.describeServerCtx(ctx)
+	delay := time.Since(now)
+	if err != nil {
+		m.conn.Close()
+		m.conn = nil
+		if m.serverMonitor.ServerHeartbeatFailed != nil {
+			publishServerHeartbeatFailed(m.serverMonitor, m.endpoint, delay, err)
 		}
+		return nil, err
 	}
 
-	return d
+	if m.serverMonitor.ServerHeartbeatSucceeded != nil {
+		publishServerHeartbeatSucceeded(m.serverMonitor, m.endpoint, delay)
+	}
+
+	d := BuildDesc(m.endpoint, isMasterResult, buildInfoResult)
+	d.SetAverageRTT(m.updateAverageRTT(delay))
+	d.HeartbeatInterval = m.heartbeatInterval
+
+	m.maybeStartStreaming(isMasterResult)
+
+	return d, nil
+}
+
+// nextHeartbeatInterval returns the delay before the next check. A
+// healthy server (or the first failure, which is retried immediately by
+// check) uses the configured heartbeatInterval; once check has given up
+// after a retry, subsequent checks back off exponentially from
+// heartbeatInterval, capped at backoffMax, with up to ±backoffJitter
+// randomness so that many monitors failing at once don't retry in
+// lockstep.
+func (m *Monitor) nextHeartbeatInterval() time.Duration {
+	if m.consecutiveFailures == 0 {
+		return m.heartbeatInterval
+	}
+
+	// double backoff up to backoffMax, stopping before each multiply would
+	// push it past the cap, so a large consecutiveFailures (a server that's
+	// been down a while) can never overflow the shift/multiply into a
+	// bogus negative duration the way a one-shot 1<<(consecutiveFailures-1)
+	// would.
+	backoff := m.heartbeatInterval
+	for i := 0; i < m.consecutiveFailures-1 && backoff < m.backoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > m.backoffMax {
+		backoff = m.backoffMax
+	}
+
+	jitter := 1 + m.backoffJitter*(2*m.randFloat64()-1)
+	return time.Duration(float64(backoff) * jitter)
+}
+
+// maybeStartStreaming begins sampling RTT on a dedicated RTTMonitor the
+// first time a server reports a topologyVersion, signalling support for
+// streaming (awaitable) isMaster. Once streaming, the heartbeat
+// connection's own latency is no longer representative, so RTT is
+// tracked separately.
+func (m *Monitor) maybeStartStreaming(isMasterResult *internal.IsMasterResult) {
+	if isMasterResult == nil || isMasterResult.TopologyVersion == nil {
+		return
+	}
+	if m.streaming() {
+		return
+	}
+
+	m.streamingLock.Lock()
+	defer m.streamingLock.Unlock()
+	if m.isStreaming {
+		return
+	}
+	m.isStreaming = true
+	m.rttMonitor = startRTTMonitor(m.endpoint, m.cfg)
+}
+
+// dialCtx dials a new monitoring connection, but abandons the dial as
+// soon as ctx is done rather than waiting indefinitely for a hung or
+// black-holed dialer: m.dialer itself takes no ctx, so dialCtx races it
+// against ctx.Done() on its own goroutine and, if ctx wins, closes
+// whatever connection the dial eventually produces instead of handing it
+// back to a caller that's already given up.
+func (m *Monitor) dialCtx(ctx context.Context) (conn.ConnectionCloser, error) {
+	type result struct {
+		conn conn.ConnectionCloser
+		err  error
+	}
+
+	resultCh := make(chan result, 1)
+	go func() {
+		c, err := m.dialer(m.endpoint, m.connOpts...)
+		resultCh <- result{c, err}
+	}()
+
+	select {
+	case r := <-resultCh:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			r := <-resultCh
+			if r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// describeServerCtx runs describeServer on m.conn but abandons it (by
+// closing the connection, which unblocks any in-progress read or write)
+// as soon as ctx is done, rather than waiting indefinitely for a slow or
+// streaming isMaster reply.
+func (m *Monitor) describeServerCtx(ctx context.Context) (*internal.IsMasterResult, *internal.BuildInfoResult, error) {
+	type result struct {
+		isMaster  *internal.IsMasterResult
+		buildInfo *internal.BuildInfoResult
+		err       error
+	}
+
+	resultCh := make(chan result, 1)
+	streamingDeadline := int64(0)
+	if m.streaming() {
+		streamingDeadline = maxAwaitTimeMS
+	}
+
+	go func() {
+		isMasterResult, buildInfoResult, err := describeServer(m.conn, streamingDeadline)
+		resultCh <- result{isMasterResult, buildInfoResult, err}
+	}()
+
+	select {
+	case r := <-resultCh:
+		return r.isMaster, r.buildInfo, r.err
+	case <-ctx.Done():
+		m.conn.Close()
+		<-resultCh // describeServer will return once the socket is closed
+		return nil, nil, ctx.Err()
+	}
 }
 
 // updateAverageRTT calcuates the averageRTT of the server
-// given its most recent RTT value
+// given its most recent RTT value. Once the monitor has switched to
+// streaming isMaster, the dedicated RTTMonitor is authoritative instead.
 func (m *Monitor) updateAverageRTT(delay time.Duration) time.Duration {
+	if rm := m.getRTTMonitor(); rm != nil {
+		return rm.EWMA()
+	}
+
 	if !m.averageRTTSet {
 		m.averageRTT = delay
+		m.averageRTTSet = true
 	} else {
 		alpha := 0.2
 		m.averageRTT = time.Duration(alpha*float64(delay) + (1-alpha)*float64(m.averageRTT))
@@ -226,12 +524,22 @@ func (m *Monitor) updateAverageRTT(delay time.Duration) time.Duration {
 	return m.averageRTT
 }
 
-func describeServer(c conn.Connection) (*internal.IsMasterResult, *internal.BuildInfoResult, error) {
+// describeServer issues isMaster and buildInfo to c. When awaitTimeoutMS
+// is non-zero, maxAwaitTimeMS is added to the isMaster command; the
+// topologyVersion from the server's previous reply is not sent with it.
+func describeServer(c conn.Connection, awaitTimeoutMS int64) (*internal.IsMasterResult, *internal.BuildInfoResult, error) {
+	isMasterCmd := bson.D{{Name: "ismaster", Value: 1}}
+	if awaitTimeoutMS > 0 {
+		isMasterCmd = append(isMasterCmd,
+			bson.DocElem{Name: "maxAwaitTimeMS", Value: awaitTimeoutMS},
+		)
+	}
+
 	isMasterReq := msg.NewCommand(
 		msg.NextRequestID(),
 		"admin",
 		true,
-		bson.D{{Name: "ismaster", Value: 1}},
+		isMasterCmd,
 	)
 	buildInfoReq := msg.NewCommand(
 		msg.NextRequestID(),
@@ -248,4 +556,4 @@ func describeServer(c conn.Connection) (*internal.IsMasterResult, *internal.Buil
 	}
 
 	return &isMasterResult, &buildInfoResult, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/10gen/mongo-go-driver/conn"
+	"github.com/10gen/mongo-go-driver/pool"
+)
+
+// newTestMonitor builds a Monitor whose monitoring goroutine does
+// nothing but wait on done, the same shape StartMonitor's goroutine has,
+// without dialing anything. It's enough to exercise Disconnect/Stop's
+// shutdown path in isolation.
+func newTestMonitor() *Monitor {
+	endpoint := conn.Endpoint("localhost:27017")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := &Monitor{
+		endpoint:       endpoint,
+		broadcaster:    newDescBroadcaster(&Desc{Endpoint: endpoint}),
+		done:           make(chan struct{}, 1),
+		checkNow:       make(chan struct{}, 1),
+		ctx:            ctx,
+		cancel:         cancel,
+		disconnectDone: make(chan struct{}),
+		pool:           pool.New(endpoint, nil),
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		<-m.done
+	}()
+
+	return m
+}
+
+// newStuckTestMonitor builds a Monitor like newTestMonitor, except its
+// monitoring goroutine never exits (it ignores done), so Disconnect's
+// m.wg.Wait() never returns. This is what a genuinely hung teardown looks
+// like, as opposed to newTestMonitor's goroutine which always exits
+// immediately.
+func newStuckTestMonitor() *Monitor {
+	endpoint := conn.Endpoint("localhost:27017")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m := &Monitor{
+		endpoint:       endpoint,
+		broadcaster:    newDescBroadcaster(&Desc{Endpoint: endpoint}),
+		done:           make(chan struct{}, 1),
+		checkNow:       make(chan struct{}, 1),
+		ctx:            ctx,
+		cancel:         cancel,
+		disconnectDone: make(chan struct{}),
+		pool:           pool.New(endpoint, nil),
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		select {} // never returns; simulates a stuck teardown
+	}()
+
+	return m
+}
+
+// TestMonitorDisconnectHonorsOwnCtx reproduces the scenario where teardown
+// is stuck: a caller with no deadline must wait for it, but a concurrent
+// caller with its own short deadline must not be held hostage by the
+// first caller's ctx and must get its own ctx's error back promptly.
+func TestMonitorDisconnectHonorsOwnCtx(t *testing.T) {
+	m := newStuckTestMonitor()
+
+	go func() {
+		_ = m.Disconnect(context.Background())
+	}()
+
+	shortCtx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := m.Disconnect(shortCtx)
+	elapsed := time.Since(start)
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Disconnect() with short-deadline ctx = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed > time.Second {
+		t.Fatalf("Disconnect() with short-deadline ctx took %v, want ~200ms; it waited on another caller's ctx instead of its own", elapsed)
+	}
+}
+
+func TestMonitorDisconnectConcurrent(t *testing.T) {
+	m := newTestMonitor()
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			errs[i] = m.Disconnect(ctx)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Disconnect calls from many goroutines did not return; deadlock")
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Disconnect() call %d = %v, want nil", i, err)
+		}
+	}
+}
+
+func TestMonitorStopConcurrentAndRepeated(t *testing.T) {
+	m := newTestMonitor()
+
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			m.Stop()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop calls from many goroutines did not return; deadlock or panic")
+	}
+
+	// calling Stop again after everyone else has already returned must
+	// still be a no-op, not a second close(m.done).
+	m.Stop()
+}
+
+func TestMonitorNextHeartbeatInterval(t *testing.T) {
+	tests := []struct {
+		name                string
+		heartbeatInterval   time.Duration
+		backoffMax          time.Duration
+		backoffJitter       float64
+		consecutiveFailures int
+		randFloat64         float64
+		want                time.Duration
+	}{
+		{
+			name:                "healthy server uses heartbeatInterval",
+			heartbeatInterval:   10 * time.Second,
+			backoffMax:          30 * time.Second,
+			backoffJitter:       0.2,
+			consecutiveFailures: 0,
+			randFloat64:         0.123, // irrelevant when there have been no failures
+			want:                10 * time.Second,
+		},
+		{
+			name:                "first failure backs off to heartbeatInterval, no jitter at midpoint",
+			heartbeatInterval:   10 * time.Second,
+			backoffMax:          30 * time.Second,
+			backoffJitter:       0.2,
+			consecutiveFailures: 1,
+			randFloat64:         0.5, // (2*0.5 - 1) == 0, so jitter multiplier is exactly 1
+			want:                10 * time.Second,
+		},
+		{
+			name:                "second backoff doubles again",
+			heartbeatInterval:   10 * time.Second,
+			backoffMax:          30 * time.Second,
+			backoffJitter:       0.2,
+			consecutiveFailures: 2,
+			randFloat64:         0.5,
+			want:                20 * time.Second,
+		},
+		{
+			name:                "backoff is capped at backoffMax",
+			heartbeatInterval:   10 * time.Second,
+			backoffMax:          30 * time.Second,
+			backoffJitter:       0.2,
+			consecutiveFailures: 10,
+			randFloat64:         0.5,
+			want:                30 * time.Second,
+		},
+		{
+			name:                "jitter scales the capped backoff at the high end",
+			heartbeatInterval:   10 * time.Second,
+			backoffMax:          30 * time.Second,
+			backoffJitter:       0.2,
+			consecutiveFailures: 10,
+			randFloat64:         1, // (2*1 - 1) == 1, so jitter multiplier is 1+backoffJitter
+			want:                36 * time.Second,
+		},
+		{
+			name:                "jitter scales the capped backoff at the low end",
+			heartbeatInterval:   10 * time.Second,
+			backoffMax:          30 * time.Second,
+			backoffJitter:       0.2,
+			consecutiveFailures: 10,
+			randFloat64:         0, // (2*0 - 1) == -1, so jitter multiplier is 1-backoffJitter
+			want:                24 * time.Second,
+		},
+		{
+			name:                "large consecutiveFailures stays capped instead of overflowing negative",
+			heartbeatInterval:   10 * time.Second,
+			backoffMax:          30 * time.Second,
+			backoffJitter:       0.2,
+			consecutiveFailures: 31, // 1<<30 would already overflow a one-shot shift-then-multiply
+			randFloat64:         0.5,
+			want:                30 * time.Second,
+		},
+		{
+			name:                "extremely large consecutiveFailures still stays capped",
+			heartbeatInterval:   10 * time.Second,
+			backoffMax:          30 * time.Second,
+			backoffJitter:       0.2,
+			consecutiveFailures: 1000,
+			randFloat64:         0.5,
+			want:                30 * time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Monitor{
+				heartbeatInterval:   tt.heartbeatInterval,
+				backoffMax:          tt.backoffMax,
+				backoffJitter:       tt.backoffJitter,
+				consecutiveFailures: tt.consecutiveFailures,
+				randFloat64:         func() float64 { return tt.randFloat64 },
+			}
+
+			got := m.nextHeartbeatInterval()
+			if got != tt.want {
+				t.Errorf("nextHeartbeatInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
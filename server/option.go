@@ -0,0 +1,90 @@
+package server
+
+import (
+	"time"
+
+	"github.com/10gen/mongo-go-driver/conn"
+)
+
+// config holds the configurable settings for a Monitor, built up by
+// applying a sequence of Options.
+type config struct {
+	connOpts          []conn.Option
+	dialer            conn.Dialer
+	heartbeatInterval time.Duration
+	serverMonitor     ServerMonitor
+	heartbeatRetry    bool
+	backoffMax        time.Duration
+	backoffJitter     float64
+}
+
+func newConfig(opts ...Option) *config {
+	cfg := &config{
+		dialer:            conn.Dial,
+		heartbeatInterval: 10 * time.Second,
+		heartbeatRetry:    true,
+		backoffMax:        30 * time.Second,
+		backoffJitter:     0.2,
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return cfg
+}
+
+// Option configures a Monitor.
+type Option func(*config)
+
+// WithConnectionOptions configures the options used to dial the
+// monitoring connection.
+func WithConnectionOptions(opts ...conn.Option) Option {
+	return func(cfg *config) {
+		cfg.connOpts = append(cfg.connOpts, opts...)
+	}
+}
+
+// WithDialer configures the dialer used to establish the monitoring
+// connection.
+func WithDialer(dialer conn.Dialer) Option {
+	return func(cfg *config) {
+		cfg.dialer = dialer
+	}
+}
+
+// WithHeartbeatInterval configures the interval between server checks.
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.heartbeatInterval = interval
+	}
+}
+
+// WithServerMonitor configures the ServerMonitor that SDAM events are
+// published to. If unset, events are not published.
+func WithServerMonitor(sm ServerMonitor) Option {
+	return func(cfg *config) {
+		cfg.serverMonitor = sm
+	}
+}
+
+// WithHeartbeatRetry configures whether a failed heartbeat is retried
+// once, immediately, on a fresh connection before the server is marked
+// Unknown. Defaults to true, per the SDAM spec.
+func WithHeartbeatRetry(retry bool) Option {
+	return func(cfg *config) {
+		cfg.heartbeatRetry = retry
+	}
+}
+
+// WithHeartbeatBackoff configures the backoff applied to checks after a
+// server has been marked Unknown: the delay doubles from
+// heartbeatInterval on each consecutive failure, up to max, and is
+// randomized by up to ±jitter (e.g. 0.2 for ±20%) so that monitors
+// failing at the same time don't recheck in lockstep.
+func WithHeartbeatBackoff(max time.Duration, jitter float64) Option {
+	return func(cfg *config) {
+		cfg.backoffMax = max
+		cfg.backoffJitter = jitter
+	}
+}
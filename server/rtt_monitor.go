@@ -0,0 +1,169 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/10gen/mongo-go-driver/conn"
+	"github.com/10gen/mongo-go-driver/internal"
+	"github.com/10gen/mongo-go-driver/msg"
+)
+
+// rttAlpha is the weight given to the most recent RTT sample in the
+// exponentially weighted moving average, matching the legacy
+// Monitor.updateAverageRTT behavior.
+const rttAlpha = 0.2
+
+// minRTTSampleInterval bounds how often the RTT monitor resamples latency
+// while in streaming mode.
+const minRTTSampleInterval = 500 * time.Millisecond
+
+// RTTMonitor samples a server's round trip time on its own connection
+// and interval, independent of the (possibly long-polling) heartbeat
+// connection. It is used once a server has switched into streaming
+// isMaster mode, where the heartbeat connection blocks for up to
+// maxAwaitTimeMS and can no longer double as an RTT sample.
+type RTTMonitor struct {
+	endpoint conn.Endpoint
+	connOpts []conn.Option
+	dialer   conn.Dialer
+	interval time.Duration
+
+	conn conn.ConnectionCloser
+
+	mu         sync.Mutex
+	averageRTT time.Duration
+	rttSet     bool
+
+	done     chan struct{}
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// startRTTMonitor starts sampling RTT on its own goroutine and returns
+// the RTTMonitor. Call Stop to terminate the goroutine and close the
+// underlying connection.
+func startRTTMonitor(endpoint conn.Endpoint, cfg *config) *RTTMonitor {
+	interval := cfg.heartbeatInterval
+	if interval < minRTTSampleInterval {
+		interval = minRTTSampleInterval
+	}
+
+	r := &RTTMonitor{
+		endpoint: endpoint,
+		connOpts: cfg.connOpts,
+		dialer:   cfg.dialer,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go r.start()
+
+	return r
+}
+
+func (r *RTTMonitor) start() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.sample()
+
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			if r.conn != nil {
+				r.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// sample takes one RTT reading. It honors r.done during the isMaster
+// round trip so that Stop, which has no deadline of its own, isn't left
+// blocked on a hung server: closing r.done while a sample is in flight
+// unblocks it by closing the connection out from under the pending
+// ExecuteCommands call, the same trick Monitor.describeServerCtx uses for
+// heartbeats. Dialing a new connection is not interrupted by r.done.
+func (r *RTTMonitor) sample() {
+	if r.conn == nil {
+		c, err := r.dialer(r.endpoint, r.connOpts...)
+		if err != nil {
+			return
+		}
+		r.conn = c
+	}
+
+	isMasterReq := msg.NewCommand(
+		msg.NextRequestID(),
+		"admin",
+		true,
+		bson.D{{Name: "ismaster", Value: 1}},
+	)
+
+	type result struct {
+		delay time.Duration
+		err   error
+	}
+	resultCh := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		var isMasterResult internal.IsMasterResult
+		err := conn.ExecuteCommands(r.conn, []msg.Request{isMasterReq}, []interface{}{&isMasterResult})
+		resultCh <- result{time.Since(start), err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			r.conn.Close()
+			r.conn = nil
+			return
+		}
+		r.updateAverageRTT(res.delay)
+	case <-r.done:
+		r.conn.Close()
+		r.conn = nil
+		<-resultCh // ExecuteCommands returns once the socket is closed
+	}
+}
+
+// updateAverageRTT folds delay into the EWMA under lock, matching the
+// alpha=0.2 weighting used before RTT sampling was split out of
+// Monitor.heartbeat.
+func (r *RTTMonitor) updateAverageRTT(delay time.Duration) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.rttSet {
+		r.averageRTT = delay
+		r.rttSet = true
+	} else {
+		r.averageRTT = time.Duration(rttAlpha*float64(delay) + (1-rttAlpha)*float64(r.averageRTT))
+	}
+
+	return r.averageRTT
+}
+
+// EWMA returns the current exponentially weighted moving average RTT.
+func (r *RTTMonitor) EWMA() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.averageRTT
+}
+
+// Stop terminates the RTT monitor's sampling goroutine and closes its
+// connection. It is safe to call Stop concurrently and more than once:
+// only the first call closes r.done.
+func (r *RTTMonitor) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+	})
+	r.wg.Wait()
+}